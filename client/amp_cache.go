@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/keroserene/go-webrtc"
+)
+
+// defaultAMPCacheURL is the AMP Cache that fronts requests to the broker
+// when domain fronting through BrokerChannel's own front domain is itself
+// blocked. See the cdn.ampproject.org /c/s/<host>/<path> convention.
+const defaultAMPCacheURL = "https://cdn.ampproject.org/c/s/"
+
+// answerComment extracts the SDP answer the broker tucks into an HTML
+// comment of the AMP document it publishes; ordinary AMP rendering ignores
+// comments, so this survives the round trip through the cache unmodified.
+var answerComment = regexp.MustCompile(`(?s)<!--\s*snowflake-answer:(.*?)-->`)
+
+// AMPCacheRendezvous negotiates with the broker by routing the offer
+// through an AMP cache instead of directly through domain fronting: the
+// broker publishes a tiny AMP document at a URL derived from the offer, and
+// the cache serves it back to the client with the SDP answer embedded.
+type AMPCacheRendezvous struct {
+	// CacheURL is the AMP cache endpoint, e.g. defaultAMPCacheURL.
+	CacheURL string
+	// BrokerHost is the broker's real hostname, embedded in the AMP cache
+	// URL so the cache knows which origin to fetch the document from.
+	BrokerHost string
+	Client     *http.Client
+}
+
+// NewAMPCacheRendezvous constructs an AMPCacheRendezvous against brokerHost
+// using the public cdn.ampproject.org cache.
+func NewAMPCacheRendezvous(brokerHost string) *AMPCacheRendezvous {
+	return &AMPCacheRendezvous{
+		CacheURL:   defaultAMPCacheURL,
+		BrokerHost: brokerHost,
+		Client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Negotiate implements Rendezvous. AMP caches only ever serve GET requests,
+// so the offer has to travel in the URL itself rather than a POST body.
+func (r *AMPCacheRendezvous) Negotiate(offer *webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	encodedOffer := base64.URLEncoding.EncodeToString([]byte(offer.Serialize()))
+	url := fmt.Sprintf("%s%s/broker/offer/%s", r.CacheURL, r.BrokerHost, encodedOffer)
+
+	resp, err := r.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// No snowflake proxy available yet; not an error, just nothing to
+		// report -- the caller will retry.
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("AMPCacheRendezvous: broker returned %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	serializedAnswer, err := extractAnswer(body)
+	if err != nil {
+		return nil, err
+	}
+	answer := webrtc.DeserializeSessionDescription(serializedAnswer)
+	if nil == answer {
+		return nil, errors.New("AMPCacheRendezvous: failed to parse SDP answer")
+	}
+	log.Println("AMPCacheRendezvous: received answer")
+	return answer, nil
+}
+
+// extractAnswer pulls the base64-encoded, serialized SDP answer out of the
+// HTML comment an AMP document embeds it in.
+func extractAnswer(body []byte) (string, error) {
+	match := answerComment.FindSubmatch(body)
+	if nil == match {
+		return "", errors.New("AMPCacheRendezvous: no answer found in AMP document")
+	}
+	decoded, err := base64.URLEncoding.DecodeString(string(match[1]))
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/keroserene/go-webrtc"
+)
+
+// testOffer is a stand-in local SDP offer for tests that exercise Negotiate's
+// HTTP plumbing; its contents don't matter since none of those tests look
+// past the encoded path it produces.
+var testOffer = &webrtc.SessionDescription{Type: "offer", Sdp: "v=0\r\n"}
+
+// TestExtractAnswer covers the regex/base64 extraction that pulls a
+// serialized SDP answer out of the HTML comment an AMP document embeds it
+// in, independent of go-webrtc's own (de)serialization.
+func TestExtractAnswer(t *testing.T) {
+	serialized := `{"type":"answer","sdp":"v=0..."}`
+	encoded := base64.URLEncoding.EncodeToString([]byte(serialized))
+	body := fmt.Sprintf("<!doctype html><html><body>\n<!--\nsnowflake-answer:%s\n-->\n</body></html>", encoded)
+
+	got, err := extractAnswer([]byte(body))
+	if err != nil {
+		t.Fatalf("extractAnswer: %v", err)
+	}
+	if got != serialized {
+		t.Fatalf("got %q, want %q", got, serialized)
+	}
+}
+
+func TestExtractAnswerNoComment(t *testing.T) {
+	if _, err := extractAnswer([]byte("<html><body>no answer here</body></html>")); err == nil {
+		t.Fatal("extractAnswer with no answer comment: got nil error")
+	}
+}
+
+func TestExtractAnswerBadBase64(t *testing.T) {
+	body := "<!--snowflake-answer:not-valid-base64!!!-->"
+	if _, err := extractAnswer([]byte(body)); err == nil {
+		t.Fatal("extractAnswer with invalid base64: got nil error")
+	}
+}
+
+// TestAMPCacheRendezvousNegotiateNotFound checks that a 404 (no proxy
+// available yet) is reported as "nothing to report", not an error.
+func TestAMPCacheRendezvousNegotiateNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	r := &AMPCacheRendezvous{CacheURL: ts.URL + "/", BrokerHost: "broker.example", Client: ts.Client()}
+	answer, err := r.Negotiate(testOffer)
+	if err != nil {
+		t.Fatalf("Negotiate: %v", err)
+	}
+	if answer != nil {
+		t.Fatalf("got answer %v, want nil", answer)
+	}
+}
+
+// TestAMPCacheRendezvousNegotiateServerError checks that a non-200,
+// non-404 response is treated as a hard error.
+func TestAMPCacheRendezvousNegotiateServerError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	r := &AMPCacheRendezvous{CacheURL: ts.URL + "/", BrokerHost: "broker.example", Client: ts.Client()}
+	if _, err := r.Negotiate(testOffer); err == nil {
+		t.Fatal("Negotiate against a 500 response: got nil error")
+	}
+}
+
+// TestAMPCacheRendezvousNegotiateNoAnswer checks that a 200 response whose
+// body has no embedded answer comment is treated as an error, not a silent
+// "no proxy available".
+func TestAMPCacheRendezvousNegotiateNoAnswer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><body>nothing embedded here</body></html>")
+	}))
+	defer ts.Close()
+
+	r := &AMPCacheRendezvous{CacheURL: ts.URL + "/", BrokerHost: "broker.example", Client: ts.Client()}
+	if _, err := r.Negotiate(testOffer); err == nil {
+		t.Fatal("Negotiate against a body with no answer: got nil error")
+	}
+}
+
+// TestAMPCacheRendezvousNegotiateRequestPath checks that the offer is
+// encoded into the request path under the broker host, as the cache's
+// GET-only /c/s/<host>/<path> convention requires.
+func TestAMPCacheRendezvousNegotiateRequestPath(t *testing.T) {
+	var gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	r := &AMPCacheRendezvous{CacheURL: ts.URL + "/", BrokerHost: "broker.example", Client: ts.Client()}
+	if _, err := r.Negotiate(testOffer); err != nil {
+		t.Fatalf("Negotiate: %v", err)
+	}
+	wantPrefix := "/broker.example/broker/offer/"
+	if !strings.HasPrefix(gotPath, wantPrefix) {
+		t.Fatalf("got path %q, want prefix %q", gotPath, wantPrefix)
+	}
+}
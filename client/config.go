@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+
+	"github.com/keroserene/go-webrtc"
+)
+
+// ConfigurationProvider supplies the ordered list of webrtc.Configurations a
+// WebRTCPeer should try, in turn, when establishing a PeerConnection.
+type ConfigurationProvider interface {
+	Configurations() []*webrtc.Configuration
+}
+
+// staticConfigurations is a ConfigurationProvider over a fixed, already
+// parsed list, as produced by LoadConfigurations or SingleConfiguration.
+type staticConfigurations []*webrtc.Configuration
+
+func (s staticConfigurations) Configurations() []*webrtc.Configuration {
+	return []*webrtc.Configuration(s)
+}
+
+// SingleConfiguration wraps a single webrtc.Configuration as a
+// ConfigurationProvider.
+func SingleConfiguration(config *webrtc.Configuration) ConfigurationProvider {
+	return staticConfigurations{config}
+}
+
+// iceServerConfig is the JSON shape of one ICE server entry: either a bare
+// STUN server (URLs only) or a TURN server with credentials.
+type iceServerConfig struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// iceConfigFile is the JSON shape of an ICE config file: a list of
+// independent webrtc.Configurations, each made up of one or more ICE
+// servers, tried in order.
+type iceConfigFile struct {
+	Configurations [][]iceServerConfig `json:"configurations"`
+}
+
+// LoadConfigurations reads the JSON file at path and returns one
+// ConfigurationProvider containing a webrtc.Configuration per entry, in
+// file order.
+func LoadConfigurations(path string) (ConfigurationProvider, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var parsed iceConfigFile
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	if len(parsed.Configurations) == 0 {
+		return nil, errors.New("ice-configs: file contains no configurations")
+	}
+	configs := make(staticConfigurations, 0, len(parsed.Configurations))
+	for _, servers := range parsed.Configurations {
+		var opts []webrtc.ConfigurationOption
+		for _, server := range servers {
+			if server.Username != "" || server.Credential != "" {
+				opts = append(opts, webrtc.OptionIceServer(
+					append(append([]string{}, server.URLs...), server.Username, server.Credential)...))
+			} else {
+				opts = append(opts, webrtc.OptionIceServer(server.URLs...))
+			}
+		}
+		configs = append(configs, webrtc.NewConfiguration(opts...))
+	}
+	log.Printf("ice-configs: loaded %d configuration(s) from %s", len(configs), path)
+	return configs, nil
+}
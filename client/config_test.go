@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "ice-configs-*.json")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(contents); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	return f.Name()
+}
+
+// TestLoadConfigurations checks that each entry in the file -- whether a
+// bare STUN server or a TURN server with credentials -- turns into one
+// webrtc.Configuration, by counting the configurations returned.
+func TestLoadConfigurations(t *testing.T) {
+	path := writeTempConfigFile(t, `{"configurations": [
+		[{"urls": ["stun:stun.l.google.com:19302"]}],
+		[{"urls": ["turn:turn.example.com:3478"], "username": "user", "credential": "pass"}]
+	]}`)
+	defer os.Remove(path)
+
+	provider, err := LoadConfigurations(path)
+	if err != nil {
+		t.Fatalf("LoadConfigurations: %v", err)
+	}
+	if got := len(provider.Configurations()); got != 2 {
+		t.Fatalf("got %d configurations, want 2", got)
+	}
+}
+
+func TestLoadConfigurationsEmpty(t *testing.T) {
+	path := writeTempConfigFile(t, `{"configurations": []}`)
+	defer os.Remove(path)
+
+	if _, err := LoadConfigurations(path); err == nil {
+		t.Fatal("LoadConfigurations with an empty configurations list: got nil error")
+	}
+}
+
+func TestLoadConfigurationsMissingFile(t *testing.T) {
+	if _, err := LoadConfigurations("/nonexistent/ice-configs.json"); err == nil {
+		t.Fatal("LoadConfigurations on a missing file: got nil error")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "log"
+
+// Dial starts a Turbotunnel Session for a new SOCKS connection and keeps it
+// supplied with WebRTCPeers for as long as it stays open, connecting a
+// replacement as soon as the current one dies.
+func Dial(configs ConfigurationProvider, rendezvous Rendezvous, metrics *Metrics) (*Session, error) {
+	clientID := NewClientID()
+	session, err := NewSession(clientID)
+	if err != nil {
+		return nil, err
+	}
+	go keepSessionFed(session, configs, rendezvous, clientID, metrics)
+	return session, nil
+}
+
+// keepSessionFed repeatedly connects a WebRTCPeer and attaches it to
+// session, moving on to the next one as soon as the current peer resets,
+// until session is closed.
+func keepSessionFed(session *Session, configs ConfigurationProvider,
+	rendezvous Rendezvous, clientID ClientID, metrics *Metrics) {
+	for {
+		select {
+		case <-session.Done():
+			return
+		default:
+		}
+		peer := NewWebRTCPeer(configs, rendezvous, clientID, metrics)
+		if err := peer.Connect(); err != nil {
+			log.Printf("WebRTC: Connect failed: %s", err)
+			peer.Close()
+			continue
+		}
+		session.Attach(peer)
+		peer.WaitForReset()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/keroserene/go-webrtc"
+)
+
+func main() {
+	iceConfigsFile := flag.String("ice-configs", "",
+		"file of JSON-encoded ICE server configurations to try in turn (see LoadConfigurations)")
+	rendezvousMethod := flag.String("rendezvous-method", "broker",
+		"rendezvous method to reach the broker: \"broker\" or \"ampcache\"")
+	brokerURL := flag.String("url", "", "URL of the broker (rendezvous-method=broker)")
+	front := flag.String("front", "", "front domain for broker HTTPS requests (rendezvous-method=broker)")
+	ampCacheBroker := flag.String("ampcache-broker", "", "broker hostname to reach through the AMP cache (rendezvous-method=ampcache)")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on (disabled if empty)")
+	flag.Parse()
+
+	var metrics *Metrics
+	if *metricsAddr != "" {
+		metrics = NewMetrics()
+		go func() {
+			if err := ListenAndServeMetrics(*metricsAddr, metrics); err != nil {
+				log.Printf("metrics: %s", err)
+			}
+		}()
+	}
+
+	configs := ConfigurationProvider(SingleConfiguration(webrtc.NewConfiguration(
+		webrtc.OptionIceServer("stun:stun.l.google.com:19302"))))
+	if *iceConfigsFile != "" {
+		loaded, err := LoadConfigurations(*iceConfigsFile)
+		if err != nil {
+			log.Fatalf("ice-configs: %s", err)
+		}
+		configs = loaded
+	}
+
+	var rendezvous Rendezvous
+	switch *rendezvousMethod {
+	case "ampcache":
+		if *ampCacheBroker == "" {
+			log.Fatal("rendezvous-method=ampcache requires -ampcache-broker")
+		}
+		rendezvous = NewAMPCacheRendezvous(*ampCacheBroker)
+	case "broker":
+		if *brokerURL != "" {
+			rendezvous = NewBrokerChannel(*brokerURL, *front)
+		}
+	default:
+		log.Fatalf("unknown -rendezvous-method %q", *rendezvousMethod)
+	}
+
+	session, err := Dial(configs, rendezvous, metrics)
+	if err != nil {
+		log.Fatalf("Dial: %s", err)
+	}
+	// TODO: hand session.Stream to the local SOCKS server.
+	select {}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics tracks client-side operational counters and serves them over an
+// optional HTTP endpoint in Prometheus text exposition format, so operators
+// running many client instances (e.g. bundled into a VPN client) can watch
+// proxy churn and negotiation health without parsing log lines. It replaces
+// the old anonymous BytesLogger embed, which only ever tracked bytes.
+type Metrics struct {
+	bytesIn               uint64
+	bytesOut              uint64
+	snowflakesConnected   uint64
+	snowflakesStaleClosed uint64
+	offerNegotiations     uint64
+
+	errorMutex    sync.Mutex
+	errorsByClass map[string]uint64
+
+	configMutex   sync.Mutex
+	configResults map[int]*configResult
+}
+
+// configResult tallies how often tryConfiguration has succeeded or failed
+// with a given index into a ConfigurationProvider's list (the entries are
+// tried one after another, not raced), so operators can tell a
+// consistently-dead ICE server apart from one that only fails some of the
+// time.
+type configResult struct {
+	succeeded uint64
+	failed    uint64
+}
+
+// NewMetrics returns a ready-to-use, empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		errorsByClass: make(map[string]uint64),
+		configResults: make(map[int]*configResult),
+	}
+}
+
+// AddInbound and AddOutbound keep the two-method face the old BytesLogger
+// had, so call sites that only care about byte counts didn't need to
+// change shape, just which object they call it on.
+func (m *Metrics) AddInbound(n int)  { atomic.AddUint64(&m.bytesIn, uint64(n)) }
+func (m *Metrics) AddOutbound(n int) { atomic.AddUint64(&m.bytesOut, uint64(n)) }
+
+// SnowflakeConnected records a WebRTCPeer successfully finishing Connect.
+func (m *Metrics) SnowflakeConnected() { atomic.AddUint64(&m.snowflakesConnected, 1) }
+
+// SnowflakeStaleClosed records checkForStaleness closing a timed-out peer.
+func (m *Metrics) SnowflakeStaleClosed() { atomic.AddUint64(&m.snowflakesStaleClosed, 1) }
+
+// OfferNegotiation records one offer/answer round trip attempted with a
+// Rendezvous, regardless of outcome.
+func (m *Metrics) OfferNegotiation() { atomic.AddUint64(&m.offerNegotiations, 1) }
+
+// CountConfigResult records whether preparePeerConnection's attempt at the
+// index'th entry of its ConfigurationProvider's list succeeded, so a
+// configuration that's always the one failing stands out from the
+// aggregate error counts in CountError.
+func (m *Metrics) CountConfigResult(index int, succeeded bool) {
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	r, ok := m.configResults[index]
+	if !ok {
+		r = &configResult{}
+		m.configResults[index] = r
+	}
+	if succeeded {
+		r.succeeded++
+	} else {
+		r.failed++
+	}
+}
+
+// CountError records a failure, bucketed by class -- a short, stable label
+// such as "ice-gathering-timeout" or "datachannel-timeout", not the raw
+// error string, so the exported series stay low-cardinality.
+func (m *Metrics) CountError(class string) {
+	m.errorMutex.Lock()
+	defer m.errorMutex.Unlock()
+	m.errorsByClass[class]++
+}
+
+// ServeHTTP renders all counters in Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# TYPE snowflake_client_bytes_in_total counter\n")
+	fmt.Fprintf(w, "snowflake_client_bytes_in_total %d\n", atomic.LoadUint64(&m.bytesIn))
+	fmt.Fprintf(w, "# TYPE snowflake_client_bytes_out_total counter\n")
+	fmt.Fprintf(w, "snowflake_client_bytes_out_total %d\n", atomic.LoadUint64(&m.bytesOut))
+	fmt.Fprintf(w, "# TYPE snowflake_client_snowflakes_connected_total counter\n")
+	fmt.Fprintf(w, "snowflake_client_snowflakes_connected_total %d\n", atomic.LoadUint64(&m.snowflakesConnected))
+	fmt.Fprintf(w, "# TYPE snowflake_client_snowflakes_stale_closed_total counter\n")
+	fmt.Fprintf(w, "snowflake_client_snowflakes_stale_closed_total %d\n", atomic.LoadUint64(&m.snowflakesStaleClosed))
+	fmt.Fprintf(w, "# TYPE snowflake_client_offer_negotiations_total counter\n")
+	fmt.Fprintf(w, "snowflake_client_offer_negotiations_total %d\n", atomic.LoadUint64(&m.offerNegotiations))
+
+	m.errorMutex.Lock()
+	fmt.Fprintf(w, "# TYPE snowflake_client_errors_total counter\n")
+	for class, count := range m.errorsByClass {
+		fmt.Fprintf(w, "snowflake_client_errors_total{class=%q} %d\n", class, count)
+	}
+	m.errorMutex.Unlock()
+
+	m.configMutex.Lock()
+	defer m.configMutex.Unlock()
+	fmt.Fprintf(w, "# TYPE snowflake_client_config_results_total counter\n")
+	for index, r := range m.configResults {
+		fmt.Fprintf(w, "snowflake_client_config_results_total{config=\"%d\",result=\"succeeded\"} %d\n", index, r.succeeded)
+		fmt.Fprintf(w, "snowflake_client_config_results_total{config=\"%d\",result=\"failed\"} %d\n", index, r.failed)
+	}
+}
+
+// ListenAndServeMetrics serves m's Prometheus text output on addr until the
+// process exits. It backs the client's optional -metrics-addr flag; callers
+// run it in its own goroutine and log the returned error if the listener
+// can't be started.
+func ListenAndServeMetrics(addr string, m *Metrics) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return http.ListenAndServe(addr, mux)
+}
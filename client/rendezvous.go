@@ -0,0 +1,15 @@
+package main
+
+import "github.com/keroserene/go-webrtc"
+
+// Rendezvous is the signaling channel a WebRTCPeer uses to hand its local
+// SDP offer to the snowflake broker and get back an SDP answer.
+// BrokerChannel is the original, HTTPS-domain-fronting implementation;
+// WebRTCPeer depends on this interface instead of on it directly so a
+// second rendezvous path (e.g. AMPCacheRendezvous) can plug in alongside it.
+type Rendezvous interface {
+	// Negotiate sends offer to the broker and returns its SDP answer.
+	// A nil answer with a nil error means no snowflake proxy was available;
+	// callers should retry later rather than treat it as a hard failure.
+	Negotiate(offer *webrtc.SessionDescription) (*webrtc.SessionDescription, error)
+}
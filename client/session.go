@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// clientIDLen is the length in bytes of the random token that identifies a
+// session across however many WebRTCPeers end up carrying it.
+const clientIDLen = 8
+
+// ClientID is generated once per SOCKS connection and attached to every
+// WebRTCPeer that carries traffic for it, so that the KCP/smux session below
+// can keep going no matter how many short-lived DataChannels come and go.
+type ClientID [clientIDLen]byte
+
+// NewClientID returns a freshly generated, random ClientID.
+func NewClientID() ClientID {
+	var id ClientID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func (id ClientID) String() string { return fmt.Sprintf("%x", [clientIDLen]byte(id)) }
+
+// Network and String make clientID usable as a net.Addr, which is all
+// peerPacketConn needs it for; KCP never inspects the value.
+func (id ClientID) Network() string { return "snowflake-clientid" }
+
+// peerPacketConn adapts a rotating cast of WebRTCPeers into a single
+// net.PacketConn, which is what KCP needs underneath it to retransmit.
+// Exactly one WebRTCPeer is "current" at a time; Attach swaps it in and
+// Detach removes it again. While no peer is attached, ReadFrom blocks and
+// WriteTo silently drops, so KCP just sees a stalled link, never a closed
+// one.
+type peerPacketConn struct {
+	clientID ClientID
+
+	mutex   sync.Mutex
+	current *WebRTCPeer
+	changed chan struct{} // closed and replaced by every Attach; closed by Close
+
+	closed bool
+}
+
+func newPeerPacketConn(clientID ClientID) *peerPacketConn {
+	return &peerPacketConn{
+		clientID: clientID,
+		changed:  make(chan struct{}),
+	}
+}
+
+// Attach makes peer the current WebRTCPeer for this connection. Whatever
+// peer was current before is left running; it is the caller's job to close
+// it once it is no longer needed.
+func (conn *peerPacketConn) Attach(peer *WebRTCPeer) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.current = peer
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+// Detach clears peer as the current WebRTCPeer, but only if it is still the
+// current one -- if it has already been replaced by a later Attach, this is
+// a no-op.
+func (conn *peerPacketConn) Detach(peer *WebRTCPeer) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.current == peer {
+		conn.current = nil
+	}
+}
+
+func (conn *peerPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn.mutex.Lock()
+		peer := conn.current
+		changed := conn.changed
+		closed := conn.closed
+		conn.mutex.Unlock()
+		if closed {
+			return 0, nil, errors.New("peerPacketConn: read from closed connection")
+		}
+		if nil == peer {
+			<-changed
+			continue
+		}
+		n, err := peer.Recv(p)
+		if err != nil {
+			// This peer died between us picking it up and reading from it;
+			// wait for the next Attach (or a moment, in case it races with
+			// Detach) and try again rather than handing KCP an error.
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		return n, conn.clientID, nil
+	}
+}
+
+func (conn *peerPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	conn.mutex.Lock()
+	peer := conn.current
+	closed := conn.closed
+	conn.mutex.Unlock()
+	if closed {
+		return 0, errors.New("peerPacketConn: write to closed connection")
+	}
+	if nil == peer {
+		// Drop the datagram; KCP will retransmit once a peer reattaches.
+		return len(p), nil
+	}
+	if err := peer.Send(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (conn *peerPacketConn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return nil
+	}
+	conn.closed = true
+	close(conn.changed)
+	return nil
+}
+
+func (conn *peerPacketConn) LocalAddr() net.Addr               { return conn.clientID }
+func (conn *peerPacketConn) SetDeadline(t time.Time) error     { return nil }
+func (conn *peerPacketConn) SetReadDeadline(t time.Time) error { return nil }
+func (conn *peerPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Session is the Turbotunnel reliability layer sitting on top of however
+// many WebRTCPeers end up carrying it one after another: KCP for
+// retransmission/ordering, smux for a single stream on top of that. The tor
+// client reads and writes Session.Stream and never notices a snowflake
+// churn underneath.
+type Session struct {
+	ClientID ClientID
+	Stream   *smux.Stream
+
+	conn *peerPacketConn
+	kcp  *kcp.UDPSession
+	smux *smux.Session
+
+	// closeChan is closed by Close, so keepSessionFed knows to stop feeding
+	// this session fresh WebRTCPeers once it's torn down.
+	closeChan chan struct{}
+}
+
+// NewSession creates a Turbotunnel session identified by clientID. It has no
+// attached WebRTCPeer yet; call Attach once one is available.
+func NewSession(clientID ClientID) (*Session, error) {
+	conn := newPeerPacketConn(clientID)
+	kcpConn, err := kcp.NewConn2(clientID, nil, 0, 0, conn)
+	if err != nil {
+		return nil, err
+	}
+	kcpConn.SetStreamMode(true)
+	kcpConn.SetWriteDelay(false)
+	smuxSession, err := smux.Client(kcpConn, smux.DefaultConfig())
+	if err != nil {
+		kcpConn.Close()
+		return nil, err
+	}
+	stream, err := smuxSession.OpenStream()
+	if err != nil {
+		smuxSession.Close()
+		kcpConn.Close()
+		return nil, err
+	}
+	return &Session{
+		ClientID:  clientID,
+		Stream:    stream,
+		conn:      conn,
+		kcp:       kcpConn,
+		smux:      smuxSession,
+		closeChan: make(chan struct{}),
+	}, nil
+}
+
+// Done returns a channel that's closed once Close has been called, so
+// keepSessionFed can stop rotating in new WebRTCPeers for a session that's
+// gone.
+func (s *Session) Done() <-chan struct{} { return s.closeChan }
+
+// Attach makes peer the WebRTCPeer currently carrying this session's
+// traffic, and records the session on peer so that checkForStaleness can
+// detach it again on timeout without tearing down the session itself.
+func (s *Session) Attach(peer *WebRTCPeer) {
+	peer.session = s
+	s.conn.Attach(peer)
+}
+
+// Detach removes peer from this session, if it is still attached. Closing
+// peer itself is the caller's responsibility.
+func (s *Session) Detach(peer *WebRTCPeer) {
+	s.conn.Detach(peer)
+}
+
+// Close tears down the KCP/smux session and its peerPacketConn. It does not
+// close whatever WebRTCPeer is currently attached -- that is a separate,
+// shorter-lived object the caller manages on its own.
+func (s *Session) Close() error {
+	select {
+	case <-s.closeChan:
+		return nil // Already closed.
+	default:
+		close(s.closeChan)
+	}
+	s.smux.Close()
+	s.kcp.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// fakeWebRTCPeer is a minimal stand-in for a WebRTCPeer that can be fed
+// incoming messages through recvChan without needing a real go-webrtc
+// DataChannel. It has no transport, so Send only works on it once link has
+// wired it to another peer.
+func fakeWebRTCPeer() *WebRTCPeer {
+	return &WebRTCPeer{
+		recvChan: make(chan []byte, 16),
+		reset:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// fakeDataChannel stands in for a real WebRTC DataChannel between two
+// WebRTCPeers under test: whatever is sent on it is delivered straight into
+// the other end's recvChan, as if it had crossed an actual wire.
+type fakeDataChannel struct {
+	remote *WebRTCPeer
+}
+
+func (f *fakeDataChannel) Send(b []byte) { f.remote.recvChan <- append([]byte(nil), b...) }
+func (f *fakeDataChannel) Close() error  { return nil }
+
+// link wires a and b together as if they were the two ends of one WebRTC
+// DataChannel, so that Send on one arrives via Recv on the other.
+func link(a, b *WebRTCPeer) {
+	a.transport = &fakeDataChannel{remote: b}
+	b.transport = &fakeDataChannel{remote: a}
+}
+
+// TestSessionSurvivesPeerSwap drives bytes through a real Session --
+// NewSession's KCP/smux stack, not just the bare peerPacketConn -- across an
+// Attach/Detach/Attach swap of its underlying WebRTCPeer, the scenario this
+// whole reliability layer exists for.
+func TestSessionSurvivesPeerSwap(t *testing.T) {
+	clientID := NewClientID()
+
+	client, err := NewSession(clientID)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer client.Close()
+
+	// The "remote" side: a second KCP/smux stack wired to the client's
+	// through fake peers, with an echo server standing in for whatever the
+	// traffic is ultimately bound for on the other side of the wire.
+	remoteConn := newPeerPacketConn(clientID)
+	defer remoteConn.Close()
+	remoteKCP, err := kcp.NewConn2(clientID, nil, 0, 0, remoteConn)
+	if err != nil {
+		t.Fatalf("remote kcp.NewConn2: %v", err)
+	}
+	remoteKCP.SetStreamMode(true)
+	remoteKCP.SetWriteDelay(false)
+	defer remoteKCP.Close()
+	remoteSmux, err := smux.Server(remoteKCP, smux.DefaultConfig())
+	if err != nil {
+		t.Fatalf("smux.Server: %v", err)
+	}
+	defer remoteSmux.Close()
+	go func() {
+		stream, err := remoteSmux.AcceptStream()
+		if err != nil {
+			return
+		}
+		io.Copy(stream, stream)
+	}()
+
+	peerA := fakeWebRTCPeer()
+	remotePeer := fakeWebRTCPeer()
+	link(peerA, remotePeer)
+	client.Attach(peerA)
+	remoteConn.Attach(remotePeer)
+
+	want := []byte("hello across peer A")
+	if _, err := client.Stream.Write(want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(client.Stream, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Swap in a new WebRTCPeer mid-stream, as checkForStaleness followed by
+	// a fresh Connect would do in production, and confirm the session keeps
+	// going through it. Closing peerA detaches it from the session and wakes
+	// the session's reader out of peerA.Recv.
+	peerA.Close()
+	peerC := fakeWebRTCPeer()
+	link(peerC, remotePeer)
+	client.Attach(peerC)
+
+	want2 := []byte("hello across peer C, after the swap")
+	if _, err := client.Stream.Write(want2); err != nil {
+		t.Fatalf("Write after swap: %v", err)
+	}
+	got2 := make([]byte, len(want2))
+	if _, err := io.ReadFull(client.Stream, got2); err != nil {
+		t.Fatalf("ReadFull after swap: %v", err)
+	}
+	if !bytes.Equal(got2, want2) {
+		t.Fatalf("got %q, want %q", got2, want2)
+	}
+}
+
+// TestPeerPacketConnSwap simulates a Session's underlying WebRTCPeer being
+// replaced mid-stream, as happens whenever a snowflake goes stale and a new
+// one takes over, and checks that bytes written before and after the swap
+// all arrive at the reader, in order, with none dropped or duplicated.
+func TestPeerPacketConnSwap(t *testing.T) {
+	clientID := NewClientID()
+	conn := newPeerPacketConn(clientID)
+	defer conn.Close()
+
+	peerA := fakeWebRTCPeer()
+	conn.Attach(peerA)
+
+	want := []byte("hello from peer A")
+	peerA.recvChan <- append([]byte(nil), want...)
+
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom from peerA: %v", err)
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Fatalf("got %q, want %q", buf[:n], want)
+	}
+
+	// Swap in a new peer, as checkForStaleness + Session.Attach would do
+	// when peerA goes stale and peerB connects in its place.
+	conn.Detach(peerA)
+	peerB := fakeWebRTCPeer()
+	conn.Attach(peerB)
+
+	want2 := []byte("hello from peer B")
+	peerB.recvChan <- append([]byte(nil), want2...)
+
+	n, _, err = conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom from peerB: %v", err)
+	}
+	if !bytes.Equal(buf[:n], want2) {
+		t.Fatalf("got %q, want %q", buf[:n], want2)
+	}
+
+	// A message arriving on the now-detached peerA must not be delivered;
+	// the swap must not leave conn reading from a stale peer.
+	peerA.recvChan <- []byte("late message from dead peerA")
+	late := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 1500)
+		n, _, err := conn.ReadFrom(buf)
+		if err == nil {
+			late <- buf[:n]
+		}
+	}()
+	select {
+	case msg := <-late:
+		t.Fatalf("ReadFrom delivered %q after peerA was detached", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestPeerPacketConnReadFromBlocksWhileDetached checks that ReadFrom blocks
+// (rather than erroring) while no peer is attached, so that KCP sees a
+// stalled link rather than a dead one during the gap between two
+// WebRTCPeers.
+func TestPeerPacketConnReadFromBlocksWhileDetached(t *testing.T) {
+	clientID := NewClientID()
+	conn := newPeerPacketConn(clientID)
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1500)
+		conn.ReadFrom(buf)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("ReadFrom returned before any peer was attached")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	peer := fakeWebRTCPeer()
+	conn.Attach(peer)
+	peer.recvChan <- []byte("x")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrom did not return after a peer was attached")
+	}
+}
+
+// TestWebRTCPeerRecvOrder exercises the net.PacketConn-like Recv face
+// directly: messages come back out of recvChan in the order they arrived,
+// and Recv reports io.EOF once the peer's done channel is closed.
+func TestWebRTCPeerRecvOrder(t *testing.T) {
+	peer := fakeWebRTCPeer()
+
+	peer.recvChan <- []byte("first")
+	peer.recvChan <- []byte("second")
+
+	buf := make([]byte, 16)
+	n, err := peer.Recv(buf)
+	if err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("Recv #1 = %q, %v", buf[:n], err)
+	}
+	n, err = peer.Recv(buf)
+	if err != nil || string(buf[:n]) != "second" {
+		t.Fatalf("Recv #2 = %q, %v", buf[:n], err)
+	}
+	close(peer.done)
+	if _, err := peer.Recv(buf); err != io.EOF {
+		t.Fatalf("Recv after close = %v, want io.EOF", err)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"log"
@@ -11,73 +10,107 @@ import (
 	"github.com/keroserene/go-webrtc"
 )
 
+// DataChannelTimeout is how long Connect will wait for the DataChannel to
+// finish opening (dc.OnOpen) before giving up on this WebRTCPeer entirely.
+// It is deliberately much shorter than SnowflakeTimeout, which bounds an
+// already-open connection's idleness: an unconnectable proxy should be
+// discarded quickly, not buffered into.
+const DataChannelTimeout = 10 * time.Second
+
+// ICEGatheringTimeout bounds how long preparePeerConnection waits for a
+// single webrtc.Configuration's ICE gathering (OnIceComplete) to finish
+// before abandoning that configuration and trying the next one.
+const ICEGatheringTimeout = 5 * time.Second
+
 // Remote WebRTC peer.
-// Implements the |Snowflake| interface, which includes
-// |io.ReadWriter|, |Resetter|, and |Connector|.
+// Implements |Resetter| and |Connector|, and exposes a net.PacketConn-like
+// Send/Recv face rather than io.ReadWriter: a peer only ever carries traffic
+// for one ClientID's Session, which is what the tor client actually reads
+// and writes, and which outlives any individual WebRTCPeer.
 //
 // Handles preparation of go-webrtc PeerConnection. Only ever has
 // one DataChannel.
 type WebRTCPeer struct {
-	id        string
-	config    *webrtc.Configuration
-	pc        *webrtc.PeerConnection
-	transport SnowflakeDataChannel // Holds the WebRTC DataChannel.
-	broker    *BrokerChannel
+	id         string
+	clientID   ClientID
+	configs    ConfigurationProvider
+	pc         *webrtc.PeerConnection
+	transport  SnowflakeDataChannel // Holds the WebRTC DataChannel.
+	rendezvous Rendezvous
+
+	// session is the Turbotunnel session this peer is currently attached to,
+	// if any. checkForStaleness uses it to detach the peer without tearing
+	// down the session itself.
+	session *Session
 
-	offerChannel  chan *webrtc.SessionDescription
 	answerChannel chan *webrtc.SessionDescription
-	errorChannel  chan error
-	recvPipe      *io.PipeReader
-	writePipe     *io.PipeWriter
+	openChannel   chan struct{} // closed once the DataChannel finishes opening
+	recvChan      chan []byte
 	lastReceive   time.Time
-	buffer        bytes.Buffer
 	reset         chan struct{}
+	// done is closed by cleanup, so Recv and any in-flight dc.OnMessage can
+	// notice the peer has died without recvChan itself ever being closed out
+	// from under a concurrent sender.
+	done chan struct{}
 
 	closed bool
 
-	BytesLogger
+	// metrics collects operational counters (bytes, connects, stale
+	// closes, negotiations, errors) for export over -metrics-addr. nil
+	// disables metrics collection entirely.
+	metrics *Metrics
 }
 
-// Construct a WebRTC PeerConnection.
-func NewWebRTCPeer(config *webrtc.Configuration,
-	broker *BrokerChannel) *WebRTCPeer {
+// Construct a WebRTCPeer that will carry traffic for clientID. No
+// PeerConnection is created here; Connect does that, trying each of configs'
+// webrtc.Configurations in turn until one of them gathers ICE candidates
+// successfully. rendezvous is the signaling channel
+// used to reach the broker -- a *BrokerChannel for domain fronting, an
+// *AMPCacheRendezvous for the AMP-cache path, or nil for copy-paste manual
+// signaling. metrics may be nil to disable metrics collection.
+func NewWebRTCPeer(configs ConfigurationProvider,
+	rendezvous Rendezvous, clientID ClientID, metrics *Metrics) *WebRTCPeer {
 	connection := new(WebRTCPeer)
 	connection.id = "snowflake-" + uniuri.New()
-	connection.config = config
-	connection.broker = broker
-	connection.offerChannel = make(chan *webrtc.SessionDescription, 1)
+	connection.clientID = clientID
+	connection.configs = configs
+	connection.rendezvous = rendezvous
+	connection.metrics = metrics
 	connection.answerChannel = make(chan *webrtc.SessionDescription, 1)
-	// Error channel is mostly for reporting during the initial SDP offer
-	// creation & local description setting, which happens asynchronously.
-	connection.errorChannel = make(chan error, 1)
+	connection.openChannel = make(chan struct{})
 	connection.reset = make(chan struct{}, 1)
+	connection.done = make(chan struct{})
 
-	// Override with something that's not NullLogger to have real logging.
-	connection.BytesLogger = &BytesNullLogger{}
-
-	// Pipes remain the same even when DataChannel gets switched.
-	connection.recvPipe, connection.writePipe = io.Pipe()
+	connection.recvChan = make(chan []byte, 16)
 	return connection
 }
 
-// Read bytes from local SOCKS.
-// As part of |io.ReadWriter|
-func (c *WebRTCPeer) Read(b []byte) (int, error) {
-	return c.recvPipe.Read(b)
+// Recv returns the next message received on the DataChannel. As part of the
+// net.PacketConn-like face that peerPacketConn reads from. recvChan is never
+// closed (a concurrent dc.OnMessage could be sending on it), so Recv instead
+// learns of the peer's death by selecting on done alongside it.
+func (c *WebRTCPeer) Recv(b []byte) (int, error) {
+	select {
+	case msg := <-c.recvChan:
+		if len(msg) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(b, msg), nil
+	case <-c.done:
+		return 0, io.EOF
+	}
 }
 
-// Writes bytes out to remote WebRTC.
-// As part of |io.ReadWriter|
-func (c *WebRTCPeer) Write(b []byte) (int, error) {
-	c.BytesLogger.AddOutbound(len(b))
-	// TODO: Buffering could be improved / separated out of WebRTCPeer.
-	if nil == c.transport {
-		log.Printf("Buffered %d bytes --> WebRTC", len(b))
-		c.buffer.Write(b)
-	} else {
-		c.transport.Send(b)
-	}
-	return len(b), nil
+// Send queues bytes for transmission over the DataChannel. As part of the
+// net.PacketConn-like face that peerPacketConn writes to. Connect never
+// returns a peer whose DataChannel hasn't already opened, so transport is
+// always present here.
+func (c *WebRTCPeer) Send(b []byte) error {
+	if nil != c.metrics {
+		c.metrics.AddOutbound(len(b))
+	}
+	c.transport.Send(b)
+	return nil
 }
 
 // As part of |Snowflake|
@@ -87,6 +120,12 @@ func (c *WebRTCPeer) Close() error {
 	}
 	// Mark for deletion.
 	c.closed = true
+	// Detach from the Turbotunnel session, if any, before tearing down the
+	// underlying PeerConnection/DataChannel -- the session survives this
+	// peer's death.
+	if nil != c.session {
+		c.session.Detach(c)
+	}
 	c.cleanup()
 	c.Reset()
 	log.Printf("WebRTC: Closing")
@@ -116,6 +155,9 @@ func (c *WebRTCPeer) checkForStaleness() {
 		if time.Since(c.lastReceive).Seconds() > SnowflakeTimeout {
 			log.Println("WebRTC: No messages received for", SnowflakeTimeout,
 				"seconds -- closing stale connection.")
+			if nil != c.metrics {
+				c.metrics.SnowflakeStaleClosed()
+			}
 			c.Close()
 			return
 		}
@@ -126,48 +168,96 @@ func (c *WebRTCPeer) checkForStaleness() {
 // As part of |Connector| interface.
 func (c *WebRTCPeer) Connect() error {
 	log.Println(c.id, " connecting...")
-	// TODO: When go-webrtc is more stable, it's possible that a new
-	// PeerConnection won't need to be re-prepared each time.
-	err := c.preparePeerConnection()
+	offer, err := c.preparePeerConnection()
 	if err != nil {
 		return err
 	}
-	err = c.establishDataChannel()
-	if err != nil {
-		return errors.New("WebRTC: Could not establish DataChannel.")
-	}
-	err = c.exchangeSDP()
+	err = c.exchangeSDP(offer)
 	if err != nil {
 		return err
 	}
+	// Don't hand back a peer until its DataChannel has actually opened --
+	// that way the collector can immediately discard proxies that never
+	// connect, instead of silently buffering writes for them.
+	select {
+	case <-c.openChannel:
+	case <-time.After(DataChannelTimeout):
+		if nil != c.metrics {
+			c.metrics.CountError("datachannel-timeout")
+		}
+		c.Close()
+		return errors.New("WebRTC: DataChannel did not open within DataChannelTimeout")
+	}
+	if nil != c.metrics {
+		c.metrics.SnowflakeConnected()
+	}
 	go c.checkForStaleness()
 	return nil
 }
 
-// Create and prepare callbacks on a new WebRTC PeerConnection.
-func (c *WebRTCPeer) preparePeerConnection() error {
+// preparePeerConnection tries each of c.configs' webrtc.Configurations in
+// turn -- a fresh PeerConnection and DataChannel for each -- until one of
+// them finishes ICE gathering within ICEGatheringTimeout. It returns the
+// resulting local SDP offer, which exchangeSDP hands to the Rendezvous.
+// Restrictive networks frequently block a single STUN/TURN server outright,
+// so trying a short list independently recovers connectability that
+// retrying the same, dead configuration never would.
+func (c *WebRTCPeer) preparePeerConnection() (*webrtc.SessionDescription, error) {
+	configs := c.configs.Configurations()
+	if len(configs) == 0 {
+		return nil, errors.New("WebRTC: no configurations available")
+	}
+	var lastErr error
+	for i, config := range configs {
+		offer, err := c.tryConfiguration(config)
+		if nil != c.metrics {
+			c.metrics.CountConfigResult(i, err == nil)
+		}
+		if err == nil {
+			return offer, nil
+		}
+		log.Printf("WebRTC: configuration %d/%d failed (%v), trying next", i+1, len(configs), err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// tryConfiguration creates a PeerConnection and DataChannel using config and
+// waits up to ICEGatheringTimeout for ICE gathering to complete. On success
+// it leaves c.pc set to the new PeerConnection and returns the local offer;
+// on failure it tears the PeerConnection back down and returns an error so
+// the caller can move on to the next configuration. offerChannel and
+// errorChannel are created fresh for this one attempt rather than reused
+// from c -- a late callback from a PeerConnection tryConfiguration already
+// abandoned must not be able to feed a later attempt's select a stale offer
+// or error.
+func (c *WebRTCPeer) tryConfiguration(config *webrtc.Configuration) (*webrtc.SessionDescription, error) {
 	if nil != c.pc {
 		c.pc.Close()
 		c.pc = nil
 	}
-	pc, err := webrtc.NewPeerConnection(c.config)
+	pc, err := webrtc.NewPeerConnection(config)
 	if err != nil {
 		log.Printf("NewPeerConnection ERROR: %s", err)
-		return err
+		if nil != c.metrics {
+			c.metrics.CountError("peerconnection-create")
+		}
+		return nil, err
 	}
+	offerChannel := make(chan *webrtc.SessionDescription, 1)
+	errorChannel := make(chan error, 1)
 	// Prepare PeerConnection callbacks.
 	pc.OnNegotiationNeeded = func() {
 		log.Println("WebRTC: OnNegotiationNeeded")
 		go func() {
 			offer, err := pc.CreateOffer()
-			// TODO: Potentially timeout and retry if ICE isn't working.
 			if err != nil {
-				c.errorChannel <- err
+				errorChannel <- err
 				return
 			}
 			err = pc.SetLocalDescription(offer)
 			if err != nil {
-				c.errorChannel <- err
+				errorChannel <- err
 				return
 			}
 		}()
@@ -179,7 +269,7 @@ func (c *WebRTCPeer) preparePeerConnection() error {
 	// TODO: This may soon be deprecated, consider OnIceGatheringStateChange.
 	pc.OnIceComplete = func() {
 		log.Printf("WebRTC: OnIceComplete")
-		c.offerChannel <- pc.LocalDescription()
+		offerChannel <- pc.LocalDescription()
 	}
 	// This callback is not expected, as the Client initiates the creation
 	// of the data channel, not the remote peer.
@@ -189,15 +279,45 @@ func (c *WebRTCPeer) preparePeerConnection() error {
 	}
 	c.pc = pc
 	log.Println("WebRTC: PeerConnection created.")
-	return nil
+
+	if err := c.establishDataChannel(pc); err != nil {
+		pc.Close()
+		c.pc = nil
+		return nil, err
+	}
+
+	select {
+	case offer := <-offerChannel:
+		return offer, nil
+	case err := <-errorChannel:
+		pc.Close()
+		c.pc = nil
+		if nil != c.metrics {
+			c.metrics.CountError("offer-create")
+		}
+		return nil, err
+	case <-time.After(ICEGatheringTimeout):
+		pc.Close()
+		c.pc = nil
+		if nil != c.metrics {
+			c.metrics.CountError("ice-gathering-timeout")
+		}
+		return nil, errors.New("WebRTC: ICE gathering timed out")
+	}
 }
 
-// Create a WebRTC DataChannel locally.
-func (c *WebRTCPeer) establishDataChannel() error {
+// Create a WebRTC DataChannel locally on pc, which must be c.pc. Every
+// callback below first checks c.pc == pc: tryConfiguration abandons a
+// configuration by calling pc.Close() on it and moving on while c.pc already
+// points at a later attempt (or back at nil), and closing an abandoned pc
+// still fires its dc's callbacks -- without this guard a late OnClose from
+// configuration #1 would tear down the WebRTCPeer that configuration #2 has
+// since built.
+func (c *WebRTCPeer) establishDataChannel(pc *webrtc.PeerConnection) error {
 	if c.transport != nil {
 		panic("Unexpected datachannel already exists!")
 	}
-	dc, err := c.pc.CreateDataChannel(c.id, webrtc.Init{})
+	dc, err := pc.CreateDataChannel(c.id, webrtc.Init{})
 	// Triggers "OnNegotiationNeeded" on the PeerConnection, which will prepare
 	// an SDP offer while other goroutines operating on this struct handle the
 	// signaling. Eventually fires "OnOpen".
@@ -206,88 +326,96 @@ func (c *WebRTCPeer) establishDataChannel() error {
 		return err
 	}
 	dc.OnOpen = func() {
+		if c.pc != pc {
+			return // This configuration was abandoned before it opened.
+		}
 		log.Println("WebRTC: DataChannel.OnOpen")
 		if nil != c.transport {
 			panic("WebRTC: transport already exists.")
 		}
-		// Flush buffered outgoing SOCKS data if necessary.
-		if c.buffer.Len() > 0 {
-			dc.Send(c.buffer.Bytes())
-			log.Println("Flushed", c.buffer.Len(), "bytes.")
-			c.buffer.Reset()
-		}
-		// Then enable the datachannel.
+		// Identify this DataChannel's traffic to whatever is on the other
+		// end as belonging to clientID, so it can be routed to the right
+		// session no matter how many WebRTCPeers come before or after this
+		// one.
+		dc.Send(c.clientID[:])
 		c.transport = dc
+		close(c.openChannel)
 	}
 	dc.OnClose = func() {
-		// Future writes will go to the buffer until a new DataChannel is available.
-		if nil == c.transport {
-			// Closed locally, as part of a reset.
+		if c.pc != pc {
+			// tryConfiguration closing an abandoned configuration's pc fires
+			// this for a dc that was never the peer's current one; nothing
+			// to do.
+			return
+		}
+		if c.closed {
+			// Closed locally, as part of cleanup.
 			log.Println("WebRTC: DataChannel.OnClose [locally]")
 			return
 		}
 		// Closed remotely, need to reset everything.
-		// Disable the DataChannel as a write destination.
 		log.Println("WebRTC: DataChannel.OnClose [remotely]")
-		c.transport = nil
 		c.Close()
 	}
 	dc.OnMessage = func(msg []byte) {
+		if c.pc != pc {
+			return
+		}
 		if len(msg) <= 0 {
 			log.Println("0 length message---")
 		}
-		c.BytesLogger.AddInbound(len(msg))
-		n, err := c.writePipe.Write(msg)
-		if err != nil {
-			// TODO: Maybe shouldn't actually close.
-			log.Println("Error writing to SOCKS pipe")
-			c.writePipe.CloseWithError(err)
+		if nil != c.metrics {
+			c.metrics.AddInbound(len(msg))
 		}
-		if n != len(msg) {
-			log.Println("Error: short write")
-			panic("short write")
+		// Never close(c.recvChan): a concurrent send here racing Close would
+		// panic. Select against done instead, so a dying peer just stops
+		// taking new messages rather than crashing the sender.
+		select {
+		case c.recvChan <- msg:
+			c.lastReceive = time.Now()
+		case <-c.done:
 		}
-		c.lastReceive = time.Now()
 	}
 	log.Println("WebRTC: DataChannel created.")
 	return nil
 }
 
-func (c *WebRTCPeer) sendOfferToBroker() {
-	if nil == c.broker {
+// sendOffer hands the local SDP offer to whatever Rendezvous is configured
+// and pushes the result (possibly nil, on no answer yet) to answerChannel.
+func (c *WebRTCPeer) sendOffer() {
+	if nil == c.rendezvous {
 		return
 	}
+	if nil != c.metrics {
+		c.metrics.OfferNegotiation()
+	}
 	offer := c.pc.LocalDescription()
-	answer, err := c.broker.Negotiate(offer)
+	answer, err := c.rendezvous.Negotiate(offer)
 	if nil != err || nil == answer {
-		log.Printf("BrokerChannel Error: %s", err)
+		log.Printf("Rendezvous error: %s", err)
+		if nil != err && nil != c.metrics {
+			c.metrics.CountError("rendezvous-negotiate")
+		}
 		answer = nil
 	}
 	c.answerChannel <- answer
 }
 
-// Block until an SDP offer is available, send it to either
-// the Broker or signal pipe, then await for the SDP answer.
-func (c *WebRTCPeer) exchangeSDP() error {
-	select {
-	case offer := <-c.offerChannel:
-		// Display for copy-paste when no broker available.
-		if nil == c.broker {
-			log.Printf("Please Copy & Paste the following to the peer:")
-			log.Printf("----------------")
-			log.Printf("\n\n" + offer.Serialize() + "\n\n")
-			log.Printf("----------------")
-		}
-	case err := <-c.errorChannel:
-		log.Println("Failed to prepare offer", err)
-		c.Close()
-		return err
+// Send offer (already fully gathered by preparePeerConnection) to either
+// the Rendezvous or signal pipe, then await the SDP answer.
+func (c *WebRTCPeer) exchangeSDP(offer *webrtc.SessionDescription) error {
+	// Display for copy-paste when no rendezvous is available.
+	if nil == c.rendezvous {
+		log.Printf("Please Copy & Paste the following to the peer:")
+		log.Printf("----------------")
+		log.Printf("\n\n" + offer.Serialize() + "\n\n")
+		log.Printf("----------------")
 	}
 	// Keep trying the same offer until a valid answer arrives.
 	var ok bool
 	var answer *webrtc.SessionDescription = nil
 	for nil == answer {
-		go c.sendOfferToBroker()
+		go c.sendOffer()
 		answer, ok = <-c.answerChannel // Blocks...
 		if !ok || nil == answer {
 			log.Printf("Failed to retrieve answer. Retrying in %d seconds", ReconnectTimeout)
@@ -306,27 +434,20 @@ func (c *WebRTCPeer) exchangeSDP() error {
 
 // Close all channels and transports
 func (c *WebRTCPeer) cleanup() {
-	if nil != c.offerChannel {
-		close(c.offerChannel)
-	}
 	if nil != c.answerChannel {
 		close(c.answerChannel)
 	}
-	if nil != c.errorChannel {
-		close(c.errorChannel)
-	}
-	// Close this side of the SOCKS pipe.
-	if nil != c.writePipe {
-		c.writePipe.Close()
-		c.writePipe = nil
+	if nil != c.done {
+		close(c.done)
 	}
+	// c.closed is already set by Close before cleanup runs, so OnClose
+	// recognizes this as a local close and won't recurse back into Close.
+	// transport and pc are closed but not cleared. Further Recv calls return
+	// io.EOF since done is closed; Send still hands its bytes to the closed
+	// transport and returns nil.
 	if nil != c.transport {
 		log.Printf("WebRTC: closing DataChannel")
-		dataChannel := c.transport
-		// Setting transport to nil *before* dc Close indicates to OnClose that
-		// this was locally triggered.
-		c.transport = nil
-		dataChannel.Close()
+		c.transport.Close()
 	}
 	if nil != c.pc {
 		log.Printf("WebRTC: closing PeerConnection")
@@ -334,6 +455,5 @@ func (c *WebRTCPeer) cleanup() {
 		if nil != err {
 			log.Printf("Error closing peerconnection...")
 		}
-		c.pc = nil
 	}
 }